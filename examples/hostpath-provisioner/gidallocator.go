@@ -0,0 +1,304 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// gidAnnotation tells kubelet to inject the allocated GID as an fsGroup
+	// when mounting the PV, the same annotation used by the in-tree
+	// network-filesystem GID allocators.
+	gidAnnotation = "pv.beta.kubernetes.io/gid"
+
+	// allocatorNamespace is where the per-StorageClass bitmap ConfigMaps live.
+	allocatorNamespace       = "kube-system"
+	allocatorConfigMapPrefix = "hostpath-provisioner-gid-table-"
+
+	gidTableKey = "gid-table"
+	gidMinKey   = "gid-min"
+	gidMaxKey   = "gid-max"
+)
+
+// gidAllocator hands out unique GIDs from a [min, max] range, one per
+// StorageClass, persisting the set of used GIDs as a bitmap in a ConfigMap so
+// allocations survive provisioner restarts. One instance of this provisioner
+// runs per node and they all share the same StorageClass-keyed ConfigMaps, so
+// every read-modify-write against the API is retried on conflict.
+type gidAllocator struct {
+	client kubernetes.Interface
+
+	mutex sync.Mutex
+}
+
+// newGidAllocator creates a GID allocator backed by client.
+func newGidAllocator(client kubernetes.Interface) *gidAllocator {
+	return &gidAllocator{
+		client: client,
+	}
+}
+
+// AllocateNext reserves and returns the lowest free GID in [min, max] for
+// className, persisting the updated bitmap to its backing ConfigMap.
+func (a *gidAllocator) AllocateNext(className string, min, max int) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var gid int
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.getOrCreateConfigMap(className, min, max)
+		if err != nil {
+			return err
+		}
+
+		table, err := newMinMaxAllocator(min, max)
+		if err != nil {
+			return err
+		}
+		if err := table.unmarshal(cm.Data[gidTableKey]); err != nil {
+			return fmt.Errorf("corrupt gid table for StorageClass %s: %v", className, err)
+		}
+
+		allocated, ok := table.allocateNext()
+		if !ok {
+			return fmt.Errorf("no free gids left in range [%d, %d] for StorageClass %s", min, max, className)
+		}
+
+		cm.Data[gidTableKey] = table.marshal()
+		if _, err := a.client.CoreV1().ConfigMaps(allocatorNamespace).Update(cm); err != nil {
+			return err
+		}
+
+		gid = allocated
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error allocating gid for StorageClass %s: %v", className, err)
+	}
+
+	return gid, nil
+}
+
+// Release returns gid to the free pool for className.
+func (a *gidAllocator) Release(className string, gid int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.client.CoreV1().ConfigMaps(allocatorNamespace).Get(configMapName(className), metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		min, _ := strconv.Atoi(cm.Data[gidMinKey])
+		max, _ := strconv.Atoi(cm.Data[gidMaxKey])
+		table, err := newMinMaxAllocator(min, max)
+		if err != nil {
+			return err
+		}
+		if err := table.unmarshal(cm.Data[gidTableKey]); err != nil {
+			return fmt.Errorf("corrupt gid table for StorageClass %s: %v", className, err)
+		}
+
+		table.release(gid)
+		cm.Data[gidTableKey] = table.marshal()
+		_, err = a.client.CoreV1().ConfigMaps(allocatorNamespace).Update(cm)
+		return err
+	})
+}
+
+func (a *gidAllocator) getOrCreateConfigMap(className string, min, max int) (*v1.ConfigMap, error) {
+	name := configMapName(className)
+	cm, err := a.client.CoreV1().ConfigMaps(allocatorNamespace).Get(name, metav1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	table, err := newMinMaxAllocator(min, max)
+	if err != nil {
+		return nil, err
+	}
+
+	cm = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: allocatorNamespace,
+		},
+		Data: map[string]string{
+			gidMinKey:   strconv.Itoa(min),
+			gidMaxKey:   strconv.Itoa(max),
+			gidTableKey: table.marshal(),
+		},
+	}
+	return a.client.CoreV1().ConfigMaps(allocatorNamespace).Create(cm)
+}
+
+func configMapName(className string) string {
+	return allocatorConfigMapPrefix + className
+}
+
+// minMaxAllocator is a bitmap over [min, max] tracking which GIDs are in use.
+type minMaxAllocator struct {
+	min, max int
+	used     []bool
+}
+
+func newMinMaxAllocator(min, max int) (*minMaxAllocator, error) {
+	if min > max {
+		return nil, fmt.Errorf("gidMin %d is greater than gidMax %d", min, max)
+	}
+	return &minMaxAllocator{
+		min:  min,
+		max:  max,
+		used: make([]bool, max-min+1),
+	}, nil
+}
+
+func (m *minMaxAllocator) allocateNext() (int, bool) {
+	for i, inUse := range m.used {
+		if !inUse {
+			m.used[i] = true
+			return m.min + i, true
+		}
+	}
+	return 0, false
+}
+
+func (m *minMaxAllocator) release(gid int) {
+	if gid < m.min || gid > m.max {
+		return
+	}
+	m.used[gid-m.min] = false
+}
+
+// reserve marks gid as used without failing if it is already taken, used
+// while reconciling allocations from existing PVs at startup.
+func (m *minMaxAllocator) reserve(gid int) {
+	if gid < m.min || gid > m.max {
+		return
+	}
+	m.used[gid-m.min] = true
+}
+
+// marshal encodes the bitmap as one base64'd byte per 8 GIDs.
+func (m *minMaxAllocator) marshal() string {
+	raw := make([]byte, (len(m.used)+7)/8)
+	for i, inUse := range m.used {
+		if inUse {
+			raw[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func (m *minMaxAllocator) unmarshal(encoded string) error {
+	if encoded == "" {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	for i := range m.used {
+		if i/8 < len(raw) {
+			m.used[i] = raw[i/8]&(1<<uint(i%8)) != 0
+		}
+	}
+	return nil
+}
+
+// reconcileGidAllocations scans existing PVs for our identity's gid
+// annotations and reserves them in their StorageClass's ConfigMap bitmap, so a restarted
+// provisioner does not hand out a GID that is already in use on disk.
+func (a *gidAllocator) reconcileGidAllocations(pvs []v1.PersistentVolume, identity string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, pv := range pvs {
+		if pv.Annotations["hostPathProvisionerIdentity"] != identity {
+			continue
+		}
+		gidStr, ok := pv.Annotations[gidAnnotation]
+		if !ok {
+			continue
+		}
+		gid, err := strconv.Atoi(gidStr)
+		if err != nil {
+			continue
+		}
+		className := pv.Spec.StorageClassName
+
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			cm, err := a.client.CoreV1().ConfigMaps(allocatorNamespace).Get(configMapName(className), metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				// No bitmap yet for this StorageClass; create it from the
+				// StorageClass's gid range so this gid is already included
+				// the next time AllocateNext runs against it.
+				sc, scErr := a.client.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+				if apierrors.IsNotFound(scErr) {
+					return nil
+				} else if scErr != nil {
+					return scErr
+				}
+				scMin, minErr := strconv.Atoi(sc.Parameters[gidMinParam])
+				scMax, maxErr := strconv.Atoi(sc.Parameters[gidMaxParam])
+				if minErr != nil || maxErr != nil {
+					return nil
+				}
+				cm, err = a.getOrCreateConfigMap(className, scMin, scMax)
+			}
+			if err != nil {
+				return err
+			}
+
+			min, _ := strconv.Atoi(cm.Data[gidMinKey])
+			max, _ := strconv.Atoi(cm.Data[gidMaxKey])
+			table, err := newMinMaxAllocator(min, max)
+			if err != nil {
+				return err
+			}
+			if err := table.unmarshal(cm.Data[gidTableKey]); err != nil {
+				return err
+			}
+
+			table.reserve(gid)
+			cm.Data[gidTableKey] = table.marshal()
+			_, err = a.client.CoreV1().ConfigMaps(allocatorNamespace).Update(cm)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
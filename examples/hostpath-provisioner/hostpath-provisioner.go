@@ -17,106 +17,200 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"text/template"
 
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 )
 
 const (
 	provisionerName = "nirmata.io/hostpath"
 
-	// following names are used to identify service via label
-	// i.e. app=zk
-	zk      = "zk"
-	mongodb = "mongodb"
-	es      = "es"
-	kafka   = "kafka"
-
 	defaultLeaderElection = false
+
+	// StorageClass parameters understood by this provisioner.
+
+	// pvRootParam is the directory under which PV-backing directories are
+	// created. Required.
+	pvRootParam = "pvRoot"
+	// pathPatternParam is a text/template pattern, evaluated relative to
+	// pvRoot, used to compute a PV's backing directory. Defaults to
+	// defaultPathPattern.
+	pathPatternParam = "pathPattern"
+	// perNamespaceSubdirParam, when "true", prefixes the default pathPattern
+	// with the PVC's namespace so that volumes from different namespaces
+	// never collide on disk even when pathPattern is left unset.
+	perNamespaceSubdirParam = "perNamespaceSubdir"
+
+	// modeParam selects the provisioning mode. Defaults to modePrivate, one
+	// directory per PV. modeShared carves group-owned subdirectories out of
+	// the shared pvRoot, see gidMinParam/gidMaxParam.
+	modeParam   = "mode"
+	modeShared  = "shared"
+	modePrivate = "private"
+
+	// gidMinParam and gidMaxParam bound the GID range the allocator hands out
+	// in modeShared. Both are required in that mode.
+	gidMinParam = "gidMin"
+	gidMaxParam = "gidMax"
+
+	sharedDirMode = 02775
+
+	defaultPathPattern = "{{.PVC.Name}}-{{.PVName}}"
+
+	// selectedNodeAnnotation is set by the scheduler when a StorageClass uses
+	// VolumeBindingMode: WaitForFirstConsumer, naming the node the PVC's pod
+	// was scheduled to. We only provision once it matches our identity.
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+
+	hostnameLabel = "kubernetes.io/hostname"
+	zoneLabel     = "topology.kubernetes.io/zone"
+	regionLabel   = "topology.kubernetes.io/region"
 )
 
-type pvDirs struct {
-	// *Dir is the directory to create PV-backing directories in
-	zkDir      string
-	esDir      string
-	mongodbDir string
-	kafkaDir   string
+// pathTemplateData is the data made available to pathPattern templates.
+type pathTemplateData struct {
+	PVC    *v1.PersistentVolumeClaim
+	PVName string
 }
 
 type hostPathProvisioner struct {
-	pvDirs
-
 	// Identity of this hostPathProvisioner, set to node's name. Used to identify
 	// "this" provisioner's PVs.
 	identity string
+
+	// client is used to look up the local Node object so Provision can mirror
+	// its topology labels onto the PV.
+	client kubernetes.Interface
+
+	// allocator hands out GIDs for modeShared StorageClasses.
+	allocator *gidAllocator
 }
 
 // NewHostPathProvisioner creates a new hostpath provisioner
-func NewHostPathProvisioner() controller.Provisioner {
+func NewHostPathProvisioner(client kubernetes.Interface) controller.Provisioner {
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
 		klog.Fatal("env variable NODE_NAME must be set so that this provisioner can identify itself")
 	}
 
-	dirs := []string{"ZK_PV_DIR", "MONGODB_PV_DIR", "ES_PV_DIR", "KAFKA_PV_DIR"}
-	dirsCache := make(map[string]string)
-	for _, dir := range dirs {
-		val := os.Getenv(dir)
-		if val == "" && dir != "ES_PV_DIR" {
-			klog.Fatalf("env variable %s must be set so that this provisioner knows where to place its data", dir)
-		}
-		dirsCache[dir] = val
-	}
-
 	return &hostPathProvisioner{
-		pvDirs: pvDirs{
-			zkDir:      dirsCache["ZK_PV_DIR"],
-			mongodbDir: dirsCache["MONGODB_PV_DIR"],
-			kafkaDir:   dirsCache["KAFKA_PV_DIR"],
-		},
-		identity: nodeName,
+		identity:  nodeName,
+		client:    client,
+		allocator: newGidAllocator(client),
 	}
 }
 
 var _ controller.Provisioner = &hostPathProvisioner{}
 
-// Provision creates a storage asset and returns a PV object representing it.
-func (p *hostPathProvisioner) Provision(options controller.ProvisionOptions) (*v1.PersistentVolume, error) {
-	var pvDir string
-	labels := options.PVC.GetLabels()
-
-	switch labels["app"] {
-	case zk:
-		pvDir = p.zkDir
-	case mongodb:
-		pvDir = p.mongodbDir
-	case es:
-		pvDir = p.esDir
-	case kafka:
-		pvDir = p.kafkaDir
-	default:
-		pvDir = "/tmp/nirmata-hostpath-provisioner"
+// pvPath computes the on-disk directory for a PV from the StorageClass
+// parameters pvRoot, pathPattern and perNamespaceSubdir. This lets a single
+// provisioner binary serve any number of StorageClasses, each rooted at its
+// own directory, without redeploying with new env vars per workload class.
+func pvPath(options controller.ProvisionOptions) (string, error) {
+	params := options.StorageClass.Parameters
+
+	pvRoot, ok := params[pvRootParam]
+	if !ok || pvRoot == "" {
+		return "", fmt.Errorf("StorageClass parameter %q is required", pvRootParam)
 	}
 
-	path := path.Join(pvDir, options.PVC.Namespace+"-"+options.PVC.Name+"-"+options.PVName)
+	pattern := params[pathPatternParam]
+	if pattern == "" {
+		pattern = defaultPathPattern
+		if params[perNamespaceSubdirParam] == "true" {
+			pattern = path.Join("{{.PVC.Namespace}}", pattern)
+		}
+	}
+
+	tmpl, err := template.New("pathPattern").Parse(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", pathPatternParam, pattern, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pathTemplateData{PVC: options.PVC, PVName: options.PVName}); err != nil {
+		return "", fmt.Errorf("error evaluating %s %q: %v", pathPatternParam, pattern, err)
+	}
+
+	return path.Join(pvRoot, buf.String()), nil
+}
 
-	if err := os.MkdirAll(path, 0755); err != nil {
+// Provision creates a storage asset and returns a PV object representing it.
+func (p *hostPathProvisioner) Provision(options controller.ProvisionOptions) (pv *v1.PersistentVolume, err error) {
+	provisionTotal.Inc()
+	defer func() {
+		if _, ignored := err.(*controller.IgnoredError); err != nil && !ignored {
+			provisionErrorsTotal.Inc()
+		}
+	}()
+
+	selectedNode := options.PVC.Annotations[selectedNodeAnnotation]
+	if selectedNode == "" {
+		return nil, &controller.IgnoredError{Reason: "no volume.kubernetes.io/selected-node annotation yet, waiting for a consumer"}
+	}
+	if selectedNode != p.identity {
+		return nil, &controller.IgnoredError{Reason: fmt.Sprintf("PVC is bound to node %s, not %s", selectedNode, p.identity)}
+	}
+
+	path, err := pvPath(options)
+	if err != nil {
 		return nil, err
 	}
 
-	pv := &v1.PersistentVolume{
+	// Look up the node before any side-effecting provisioning branch runs:
+	// once a branch below allocates a GID or formats and mounts a loop
+	// device, the only record of that allocation is the PV annotation we
+	// are about to build, so a transient failure afterwards would leak it
+	// with no way for Delete or the startup reconcilers to find it again.
+	node, err := p.client.CoreV1().Nodes().Get(p.identity, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up node %s: %v", p.identity, err)
+	}
+
+	annotations := map[string]string{
+		"hostPathProvisionerIdentity": p.identity,
+		"hostpath":                    path,
+	}
+
+	pvRoot := options.StorageClass.Parameters[pvRootParam]
+	requestedSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+
+	switch {
+	case options.StorageClass.Parameters[enforceCapacityParam] == "true":
+		imagePath, loopDevice, err := provisionLoopBackedVolume(pvRoot, options.PVName, path, requestedSize.Value(), options.StorageClass.Parameters[fsTypeParam])
+		if err != nil {
+			return nil, err
+		}
+		annotations[imagePathAnnotation] = imagePath
+		annotations[loopDeviceAnnotation] = loopDevice
+	case options.StorageClass.Parameters[modeParam] == modeShared:
+		gid, err := p.createSharedDir(path, options.StorageClass.Name, options.StorageClass.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		annotations[gidAnnotation] = strconv.Itoa(gid)
+	default:
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	pv = &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
-			Annotations: map[string]string{
-				"hostPathProvisionerIdentity": p.identity,
-				"hostpath":                    path,
-			},
+			Name:        options.PVName,
+			Annotations: annotations,
+			Labels:      topologyLabels(node),
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
@@ -129,6 +223,21 @@ func (p *hostPathProvisioner) Provision(options controller.ProvisionOptions) (*v
 					Path: path,
 				},
 			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      hostnameLabel,
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{p.identity},
+								},
+							},
+						},
+					},
+				},
+			},
 		},
 	}
 
@@ -137,9 +246,63 @@ func (p *hostPathProvisioner) Provision(options controller.ProvisionOptions) (*v
 	return pv, nil
 }
 
+// createSharedDir allocates a GID for className from [gidMin, gidMax], then
+// creates path group-owned by that GID with mode 2775 so any pod in the
+// group can share it without running as root.
+func (p *hostPathProvisioner) createSharedDir(path, className string, params map[string]string) (int, error) {
+	gidMin, err := strconv.Atoi(params[gidMinParam])
+	if err != nil {
+		return 0, fmt.Errorf("StorageClass parameter %q must be set to an integer in mode=shared", gidMinParam)
+	}
+	gidMax, err := strconv.Atoi(params[gidMaxParam])
+	if err != nil {
+		return 0, fmt.Errorf("StorageClass parameter %q must be set to an integer in mode=shared", gidMaxParam)
+	}
+
+	gid, err := p.allocator.AllocateNext(className, gidMin, gidMax)
+	if err != nil {
+		return 0, fmt.Errorf("error allocating gid for StorageClass %s: %v", className, err)
+	}
+
+	if err := os.MkdirAll(path, sharedDirMode); err != nil {
+		p.allocator.Release(className, gid)
+		return 0, err
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		p.allocator.Release(className, gid)
+		return 0, err
+	}
+	if err := os.Chmod(path, sharedDirMode); err != nil {
+		p.allocator.Release(className, gid)
+		return 0, err
+	}
+
+	return gid, nil
+}
+
+// topologyLabels mirrors the zone/region topology labels of node onto the PV
+// so the scheduler can bind pods back to the right place.
+func topologyLabels(node *v1.Node) map[string]string {
+	labels := map[string]string{}
+	if zone, ok := node.Labels[zoneLabel]; ok {
+		labels[zoneLabel] = zone
+	}
+	if region, ok := node.Labels[regionLabel]; ok {
+		labels[regionLabel] = region
+	}
+	return labels
+}
+
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
-func (p *hostPathProvisioner) Delete(volume *v1.PersistentVolume) error {
+func (p *hostPathProvisioner) Delete(volume *v1.PersistentVolume) (err error) {
+	deleteTotal.Inc()
+	defer func() {
+		if _, ignored := err.(*controller.IgnoredError); err != nil && !ignored {
+			deleteErrorsTotal.Inc()
+		}
+	}()
+
 	ann, ok := volume.Annotations["hostPathProvisionerIdentity"]
 	if !ok {
 		return errors.New("identity annotation not found on PV")
@@ -153,10 +316,26 @@ func (p *hostPathProvisioner) Delete(volume *v1.PersistentVolume) error {
 		return errors.New("hostpath annotation not found on PV")
 	}
 
-	if err := os.RemoveAll(path); err != nil {
+	imagePath, loopBacked := volume.Annotations[imagePathAnnotation]
+	if loopBacked {
+		loopDevice := volume.Annotations[loopDeviceAnnotation]
+		if err := deleteLoopBackedVolume(path, imagePath, loopDevice); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(path); err != nil {
 		return err
 	}
 
+	if gidStr, ok := volume.Annotations[gidAnnotation]; ok {
+		gid, err := strconv.Atoi(gidStr)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation %q: %v", gidAnnotation, gidStr, err)
+		}
+		if err := p.allocator.Release(volume.Spec.StorageClassName, gid); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
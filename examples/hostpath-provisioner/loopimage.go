@@ -0,0 +1,174 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// enforceCapacityParam, when "true", backs each PV with a loop-mounted
+	// filesystem image sized to the PVC request instead of a bare directory,
+	// so a pod can no longer fill the whole host disk.
+	enforceCapacityParam = "enforceCapacity"
+	// fsTypeParam selects the filesystem used to format the backing image.
+	// Defaults to defaultFsType.
+	fsTypeParam = "fsType"
+
+	defaultFsType = "ext4"
+
+	// imagesSubdir is the directory under pvRoot holding backing images.
+	imagesSubdir = ".images"
+
+	// imagePathAnnotation and loopDeviceAnnotation record where a PV's
+	// backing image and attached loop device are, so Delete can unwind them
+	// and a restarted provisioner can reattach them.
+	imagePathAnnotation  = "hostpath.sigs.k8s.io/loop-image"
+	loopDeviceAnnotation = "hostpath.sigs.k8s.io/loop-device"
+)
+
+// provisionLoopBackedVolume truncates a sparse image sized to size under
+// pvRoot/.images, formats it fsType, and mounts it at path via a loop device.
+// It returns the image path and the loop device so they can be annotated
+// onto the PV for Delete and for reconciliation after a restart.
+func provisionLoopBackedVolume(pvRoot, pvName, path string, size int64, fsType string) (imagePath, loopDevice string, err error) {
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	imagesDir := filepath.Join(pvRoot, imagesSubdir)
+	if err := os.MkdirAll(imagesDir, 0700); err != nil {
+		return "", "", err
+	}
+	imagePath = filepath.Join(imagesDir, pvName+".img")
+
+	f, err := os.Create(imagePath)
+	if err != nil {
+		return "", "", fmt.Errorf("error creating backing image %s: %v", imagePath, err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(imagePath)
+		return "", "", fmt.Errorf("error sizing backing image %s: %v", imagePath, err)
+	}
+	f.Close()
+
+	if out, err := exec.Command("mkfs."+fsType, imagePath).CombinedOutput(); err != nil {
+		os.Remove(imagePath)
+		return "", "", fmt.Errorf("error formatting %s as %s: %v: %s", imagePath, fsType, err, out)
+	}
+
+	loopDevice, err = attachLoopDevice(imagePath)
+	if err != nil {
+		os.Remove(imagePath)
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		detachLoopDevice(loopDevice)
+		os.Remove(imagePath)
+		return "", "", err
+	}
+
+	if out, err := exec.Command("mount", loopDevice, path).CombinedOutput(); err != nil {
+		detachLoopDevice(loopDevice)
+		os.Remove(imagePath)
+		return "", "", fmt.Errorf("error mounting %s at %s: %v: %s", loopDevice, path, err, out)
+	}
+
+	return imagePath, loopDevice, nil
+}
+
+// deleteLoopBackedVolume unwinds provisionLoopBackedVolume: it unmounts path,
+// detaches loopDevice, removes imagePath, and removes the now-empty
+// mountpoint directory at path itself.
+func deleteLoopBackedVolume(path, imagePath, loopDevice string) error {
+	if out, err := exec.Command("umount", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("error unmounting %s: %v: %s", path, err, out)
+	}
+	if err := detachLoopDevice(loopDevice); err != nil {
+		return err
+	}
+	if err := os.Remove(imagePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing backing image %s: %v", imagePath, err)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("error removing mountpoint %s: %v", path, err)
+	}
+	return nil
+}
+
+func attachLoopDevice(imagePath string) (string, error) {
+	out, err := exec.Command("losetup", "--find", "--show", imagePath).Output()
+	if err != nil {
+		return "", fmt.Errorf("error attaching loop device for %s: %v", imagePath, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func detachLoopDevice(loopDevice string) error {
+	if out, err := exec.Command("losetup", "-d", loopDevice).CombinedOutput(); err != nil {
+		return fmt.Errorf("error detaching loop device %s: %v: %s", loopDevice, err, out)
+	}
+	return nil
+}
+
+// reconcileLoopBackedVolumes re-mounts the backing images of this identity's
+// enforceCapacity PVs after a provisioner pod restart, since hostPath mounts
+// do not survive the container. The loop device number is not guaranteed to
+// be stable across restarts, so the PV's loop-device annotation is updated
+// to match.
+func reconcileLoopBackedVolumes(client kubernetes.Interface, pvs []v1.PersistentVolume, identity string) error {
+	for i := range pvs {
+		pv := &pvs[i]
+		if pv.Annotations["hostPathProvisionerIdentity"] != identity {
+			continue
+		}
+		imagePath, ok := pv.Annotations[imagePathAnnotation]
+		if !ok {
+			continue
+		}
+		path := pv.Annotations["hostpath"]
+
+		loopDevice, err := attachLoopDevice(imagePath)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		if out, err := exec.Command("mount", loopDevice, path).CombinedOutput(); err != nil {
+			return fmt.Errorf("error remounting %s at %s: %v: %s", loopDevice, path, err, out)
+		}
+
+		pv.Annotations[loopDeviceAnnotation] = loopDevice
+		if _, err := client.CoreV1().PersistentVolumes().Update(pv); err != nil {
+			return fmt.Errorf("error updating loop device annotation on PV %s: %v", pv.Name, err)
+		}
+
+		klog.Infof("reattached loop-backed volume %s at %s via %s\n", pv.Name, path, loopDevice)
+	}
+	return nil
+}
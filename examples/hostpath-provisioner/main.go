@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+func main() {
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.Fatalf("failed to create in-cluster config: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("failed to create client: %v", err)
+	}
+
+	serverVersion, err := client.Discovery().ServerVersion()
+	if err != nil {
+		klog.Fatalf("error getting server version: %v", err)
+	}
+
+	identity := os.Getenv("NODE_NAME")
+	hostPathProvisioner := NewHostPathProvisioner(client)
+
+	existingPVs, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Fatalf("error listing PVs for startup reconciliation: %v", err)
+	}
+	if err := newGidAllocator(client).reconcileGidAllocations(existingPVs.Items, identity); err != nil {
+		klog.Fatalf("error reconciling gid allocations: %v", err)
+	}
+	if err := reconcileLoopBackedVolumes(client, existingPVs.Items, identity); err != nil {
+		klog.Fatalf("error reconciling loop-backed volumes: %v", err)
+	}
+
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if metricsAddr == "" {
+		metricsAddr = defaultMetricsAddr
+	}
+	StartMetricsServer(metricsAddr)
+	go RunPVMetricsCollector(client, identity, defaultMetricsInterval, wait.NeverStop)
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: provisionerName})
+	go RunRecycler(newRecycler(client, identity, recorder), defaultRecyclerPollInterval, wait.NeverStop)
+
+	pc := controller.NewProvisionController(
+		client,
+		provisionerName,
+		hostPathProvisioner,
+		serverVersion.GitVersion,
+		controller.LeaderElection(getLeaderElection()),
+	)
+
+	pc.Run(wait.NeverStop)
+}
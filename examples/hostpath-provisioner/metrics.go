@@ -0,0 +1,182 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// defaultMetricsAddr is where /metrics is served from, overridable via
+	// the METRICS_ADDR env var.
+	defaultMetricsAddr = ":9100"
+
+	defaultMetricsInterval = 30 * time.Second
+)
+
+var (
+	pvLabels = []string{"pv_name", "pvc_namespace", "pvc_name", "storage_class"}
+
+	pvCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hostpath_pv_capacity_bytes",
+		Help: "Total size of the filesystem backing a PV, in bytes.",
+	}, pvLabels)
+	pvUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hostpath_pv_used_bytes",
+		Help: "Used space on the filesystem backing a PV, in bytes.",
+	}, pvLabels)
+	pvAvailableBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hostpath_pv_available_bytes",
+		Help: "Available space on the filesystem backing a PV, in bytes.",
+	}, pvLabels)
+	pvInodesUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hostpath_pv_inodes_used",
+		Help: "Used inodes on the filesystem backing a PV.",
+	}, pvLabels)
+
+	provisionTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "provision_total",
+		Help: "Total number of Provision calls.",
+	})
+	provisionErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "provision_errors_total",
+		Help: "Total number of Provision calls that returned an error other than an IgnoredError.",
+	})
+	deleteTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delete_total",
+		Help: "Total number of Delete calls.",
+	})
+	deleteErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delete_errors_total",
+		Help: "Total number of Delete calls that returned an error other than an IgnoredError.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pvCapacityBytes, pvUsedBytes, pvAvailableBytes, pvInodesUsed,
+		provisionTotal, provisionErrorsTotal, deleteTotal, deleteErrorsTotal,
+	)
+}
+
+// StartMetricsServer serves /metrics on addr in the background. Call once
+// from main; addr is typically defaultMetricsAddr or the METRICS_ADDR env
+// var.
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			klog.Errorf("metrics server on %s exited: %v", addr, err)
+		}
+	}()
+}
+
+// RunPVMetricsCollector periodically statfs's the backing directory of every
+// PV owned by identity and updates the capacity/usage gauges, until stop is
+// closed.
+func RunPVMetricsCollector(client kubernetes.Interface, identity string, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = defaultMetricsInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := collectPVMetrics(client, identity); err != nil {
+				klog.Errorf("error collecting PV metrics: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// seenPVLabels tracks the label set last reported for each PV, so a
+// collection pass can drop gauges for PVs that have since been deleted
+// instead of leaking stale series forever.
+var seenPVLabels = map[string]prometheus.Labels{}
+
+func collectPVMetrics(client kubernetes.Interface, identity string) error {
+	pvs, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, pv := range pvs.Items {
+		if pv.Annotations["hostPathProvisionerIdentity"] != identity {
+			continue
+		}
+		path, ok := pv.Annotations["hostpath"]
+		if !ok {
+			continue
+		}
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			klog.Errorf("error statfs'ing %s for PV %s: %v", path, pv.Name, err)
+			continue
+		}
+
+		pvcNamespace, pvcName := "", ""
+		if pv.Spec.ClaimRef != nil {
+			pvcNamespace = pv.Spec.ClaimRef.Namespace
+			pvcName = pv.Spec.ClaimRef.Name
+		}
+		labels := prometheus.Labels{
+			"pv_name":       pv.Name,
+			"pvc_namespace": pvcNamespace,
+			"pvc_name":      pvcName,
+			"storage_class": pv.Spec.StorageClassName,
+		}
+
+		blockSize := uint64(stat.Bsize)
+		pvCapacityBytes.With(labels).Set(float64(stat.Blocks * blockSize))
+		pvAvailableBytes.With(labels).Set(float64(stat.Bavail * blockSize))
+		pvUsedBytes.With(labels).Set(float64((stat.Blocks - stat.Bfree) * blockSize))
+		pvInodesUsed.With(labels).Set(float64(stat.Files - stat.Ffree))
+
+		current[pv.Name] = true
+		seenPVLabels[pv.Name] = labels
+	}
+
+	for name, labels := range seenPVLabels {
+		if current[name] {
+			continue
+		}
+		pvCapacityBytes.Delete(labels)
+		pvAvailableBytes.Delete(labels)
+		pvUsedBytes.Delete(labels)
+		pvInodesUsed.Delete(labels)
+		delete(seenPVLabels, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
+)
+
+const (
+	// recyclerImageParam, recyclerTimeoutParam and recyclerNamespaceParam
+	// configure the scrubber pod spawned by Recycle. All three are optional.
+	recyclerImageParam     = "recyclerImage"
+	recyclerTimeoutParam   = "recyclerTimeout"
+	recyclerNamespaceParam = "recyclerNamespace"
+
+	defaultRecyclerImage         = "busybox:1.31"
+	defaultRecyclerTimeoutSecond = 300
+	// defaultRecyclerNamespace deliberately isn't kube-system: many clusters
+	// lock that namespace down via RBAC/PodSecurity, and it has nothing to
+	// do with the GID allocator ConfigMaps that also happen to live there.
+	defaultRecyclerNamespace = "hostpath-provisioner"
+
+	recyclerPodPrefix = "hostpath-recycler-"
+
+	// scrubMountPath is where the recycler pod mounts the PV's hostPath
+	// directory, matching the in-tree hostPath recycler's convention.
+	scrubMountPath = "/scrub"
+	scrubCommand   = "rm -rf /scrub/..?* /scrub/.[!.]* /scrub/*"
+
+	defaultRecyclerPollInterval = 10 * time.Second
+)
+
+// recycler implements the Recycle path of the reclaim policy: instead of
+// deleting a released PV's directory outright, it scrubs the directory's
+// contents with a short-lived pod on the owning node and returns the PV to
+// Available, mirroring the (removed) in-tree hostPath recycler.
+type recycler struct {
+	client   kubernetes.Interface
+	identity string
+	recorder record.EventRecorder
+}
+
+func newRecycler(client kubernetes.Interface, identity string, recorder record.EventRecorder) *recycler {
+	return &recycler{
+		client:   client,
+		identity: identity,
+		recorder: recorder,
+	}
+}
+
+// Recycle scrubs pv's backing directory with a pod on this provisioner's
+// node, and on success clears pv's claimRef so it becomes Available again.
+// It is a no-op, returning controller.IgnoredError, for PVs this provisioner
+// does not own.
+func (r *recycler) Recycle(pv *v1.PersistentVolume) error {
+	if pv.Annotations["hostPathProvisionerIdentity"] != r.identity {
+		return &controller.IgnoredError{Reason: "identity annotation on PV does not match ours"}
+	}
+	path, ok := pv.Annotations["hostpath"]
+	if !ok {
+		return fmt.Errorf("hostpath annotation not found on PV %s", pv.Name)
+	}
+
+	sc, err := r.client.StorageV1().StorageClasses().Get(pv.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error looking up StorageClass %s: %v", pv.Spec.StorageClassName, err)
+	}
+
+	image := sc.Parameters[recyclerImageParam]
+	if image == "" {
+		image = defaultRecyclerImage
+	}
+	namespace := sc.Parameters[recyclerNamespaceParam]
+	if namespace == "" {
+		namespace = defaultRecyclerNamespace
+	}
+	timeout := defaultRecyclerTimeoutSecond
+	if t, err := strconv.Atoi(sc.Parameters[recyclerTimeoutParam]); err == nil && t > 0 {
+		timeout = t
+	}
+
+	pod, err := r.client.CoreV1().Pods(namespace).Create(scrubberPod(pv.Name, path, image, r.identity))
+	if err != nil {
+		return fmt.Errorf("error creating scrubber pod for PV %s: %v", pv.Name, err)
+	}
+	defer r.client.CoreV1().Pods(namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+
+	if err := r.awaitScrubberPod(pv, namespace, pod.Name, time.Duration(timeout)*time.Second); err != nil {
+		return err
+	}
+
+	pv.Spec.ClaimRef = nil
+	if _, err := r.client.CoreV1().PersistentVolumes().Update(pv); err != nil {
+		return fmt.Errorf("error clearing claimRef on PV %s: %v", pv.Name, err)
+	}
+
+	return nil
+}
+
+// RunRecycler polls for PVs this identity owns that are Released with a
+// Recycle reclaim policy and runs Recycle on each, until stop is closed.
+// There is no PV informer in this provisioner, so it watches by polling
+// rather than via a shared cache, mirroring RunPVMetricsCollector.
+func RunRecycler(r *recycler, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = defaultRecyclerPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.recycleReleasedVolumes()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *recycler) recycleReleasedVolumes() {
+	pvs, err := r.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("error listing PVs to recycle: %v", err)
+		return
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRecycle {
+			continue
+		}
+		if pv.Status.Phase != v1.VolumeReleased {
+			continue
+		}
+		if pv.Annotations["hostPathProvisionerIdentity"] != r.identity {
+			continue
+		}
+
+		if err := r.Recycle(pv); err != nil {
+			if _, ignored := err.(*controller.IgnoredError); !ignored {
+				klog.Errorf("error recycling PV %s: %v", pv.Name, err)
+			}
+		}
+	}
+}
+
+// awaitScrubberPod polls the scrubber pod until it succeeds, fails, or
+// timeout elapses, relaying its events onto pv as they are observed.
+func (r *recycler) awaitScrubberPod(pv *v1.PersistentVolume, namespace, podName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	seen := map[string]bool{}
+
+	for time.Now().Before(deadline) {
+		pod, err := r.client.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("scrubber pod %s disappeared before completing", podName)
+			}
+			return err
+		}
+
+		events, err := r.client.CoreV1().Events(namespace).List(metav1.ListOptions{
+			FieldSelector: fmt.Sprintf("involvedObject.name=%s,involvedObject.namespace=%s", pod.Name, pod.Namespace),
+		})
+		if err == nil {
+			for _, event := range events.Items {
+				if seen[string(event.UID)] {
+					continue
+				}
+				seen[string(event.UID)] = true
+				r.recorder.Event(pv, event.Type, event.Reason, event.Message)
+			}
+		}
+
+		switch pod.Status.Phase {
+		case v1.PodSucceeded:
+			return nil
+		case v1.PodFailed:
+			return fmt.Errorf("scrubber pod %s failed: %s", podName, pod.Status.Message)
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+
+	return fmt.Errorf("timed out after %s waiting for scrubber pod %s", timeout, podName)
+}
+
+func scrubberPod(pvName, hostPath, image, nodeName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: recyclerPodPrefix,
+			Labels: map[string]string{
+				"app":                "hostpath-provisioner-recycler",
+				"hostpath-pv-source": pvName,
+			},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			NodeSelector: map[string]string{
+				hostnameLabel: nodeName,
+			},
+			Containers: []v1.Container{
+				{
+					Name:    "scrubber",
+					Image:   image,
+					Command: []string{"/bin/sh", "-c", scrubCommand},
+					VolumeMounts: []v1.VolumeMount{
+						{Name: "scrub", MountPath: scrubMountPath},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "scrub",
+					VolumeSource: v1.VolumeSource{
+						HostPath: &v1.HostPathVolumeSource{Path: hostPath},
+					},
+				},
+			},
+		},
+	}
+}